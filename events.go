@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// eventKind is the forge-agnostic event type (push, pull_request, create
+// for tags, release) that a Forge.Parse call normalizes a payload into.
+type eventKind string
+
+const (
+	eventPush        eventKind = "push"
+	eventPullRequest eventKind = "pull_request"
+	eventTag         eventKind = "create"
+	eventRelease     eventKind = "release"
+)
+
+// PullRequestWebhook represents a Forgejo/Gitea/GitHub pull_request event;
+// the two forges share this shape closely enough to reuse one struct.
+type PullRequestWebhook struct {
+	Action      string `json:"action"`
+	Number      int    `json:"number"`
+	PullRequest struct {
+		Title string `json:"title"`
+		Head  struct {
+			Ref  string `json:"ref"`
+			SHA  string `json:"sha"`
+			Repo struct {
+				Fork bool `json:"fork"`
+			} `json:"repo"`
+		} `json:"head"`
+		Base struct {
+			Ref string `json:"ref"`
+		} `json:"base"`
+	} `json:"pull_request"`
+	Repository struct {
+		Name     string `json:"name"`
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+	Sender struct {
+		Login string `json:"login"`
+	} `json:"sender"`
+}
+
+// CreateWebhook represents a Forgejo/Gitea/GitHub create event (branch or
+// tag).
+type CreateWebhook struct {
+	SHA        string `json:"sha"`
+	Ref        string `json:"ref"`
+	RefType    string `json:"ref_type"`
+	Repository struct {
+		Name     string `json:"name"`
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+	Sender struct {
+		Login string `json:"login"`
+	} `json:"sender"`
+}
+
+// ReleaseWebhook represents a Forgejo/Gitea/GitHub release event.
+type ReleaseWebhook struct {
+	Action  string `json:"action"`
+	Release struct {
+		TagName         string `json:"tag_name"`
+		Name            string `json:"name"`
+		TargetCommitish string `json:"target_commitish"`
+	} `json:"release"`
+	Repository struct {
+		Name     string `json:"name"`
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+	Sender struct {
+		Login string `json:"login"`
+	} `json:"sender"`
+}
+
+// parseGiteaPushEvent parses the Forgejo/Gitea/GitHub push payload shape
+// (they're identical on the fields we use).
+func parseGiteaPushEvent(body []byte) (*NormalizedEvent, error) {
+	var webhook ForgejoWebhook
+	if err := json.Unmarshal(body, &webhook); err != nil {
+		return nil, fmt.Errorf("invalid push payload: %w", err)
+	}
+
+	pusher := webhook.Pusher.Username
+	if pusher == "" {
+		pusher = webhook.Pusher.Name // GitHub push payloads only set pusher.name
+	}
+
+	branch := strings.TrimPrefix(webhook.Ref, "refs/heads/")
+	return &NormalizedEvent{
+		Kind:        eventPush,
+		Repo:        webhook.Repository.FullName,
+		RepoName:    webhook.Repository.Name,
+		Branch:      branch,
+		Commit:      webhook.HeadCommit.ID,
+		Message:     webhook.HeadCommit.Message,
+		AuthorName:  webhook.HeadCommit.Author.Name,
+		AuthorEmail: webhook.HeadCommit.Author.Email,
+		Pusher:      pusher,
+	}, nil
+}
+
+func parseGiteaPullRequestEvent(body []byte) (*NormalizedEvent, error) {
+	var webhook PullRequestWebhook
+	if err := json.Unmarshal(body, &webhook); err != nil {
+		return nil, fmt.Errorf("invalid pull_request payload: %w", err)
+	}
+
+	pr := webhook.PullRequest
+	return &NormalizedEvent{
+		Kind:          eventPullRequest,
+		Repo:          webhook.Repository.FullName,
+		RepoName:      webhook.Repository.Name,
+		Branch:        pr.Head.Ref,
+		BaseBranch:    pr.Base.Ref,
+		Commit:        pr.Head.SHA,
+		Message:       fmt.Sprintf("PR #%d: %s", webhook.Number, pr.Title),
+		Pusher:        webhook.Sender.Login,
+		PullRequestID: fmt.Sprintf("%d", webhook.Number),
+		IsForkPR:      pr.Head.Repo.Fork,
+	}, nil
+}
+
+// parseGiteaTagEvent handles the "create" event, which also fires for
+// branch creation; it returns a nil NormalizedEvent (not an error) when the
+// ref being created isn't a tag, so the caller can skip it quietly.
+func parseGiteaTagEvent(body []byte) (*NormalizedEvent, error) {
+	var webhook CreateWebhook
+	if err := json.Unmarshal(body, &webhook); err != nil {
+		return nil, fmt.Errorf("invalid create payload: %w", err)
+	}
+	if webhook.RefType != "tag" {
+		return nil, nil
+	}
+
+	return &NormalizedEvent{
+		Kind:     eventTag,
+		Repo:     webhook.Repository.FullName,
+		RepoName: webhook.Repository.Name,
+		Branch:   fmt.Sprintf("refs/tags/%s", webhook.Ref),
+		Commit:   webhook.SHA,
+		Message:  fmt.Sprintf("Tag %s", webhook.Ref),
+		Pusher:   webhook.Sender.Login,
+		Tag:      webhook.Ref,
+	}, nil
+}
+
+func parseGiteaReleaseEvent(body []byte) (*NormalizedEvent, error) {
+	var webhook ReleaseWebhook
+	if err := json.Unmarshal(body, &webhook); err != nil {
+		return nil, fmt.Errorf("invalid release payload: %w", err)
+	}
+
+	// target_commitish is usually a branch name (e.g. "main"), not a SHA;
+	// the webhook payload doesn't carry the tag's actual commit. Only trust
+	// it as the commit if it looks like a SHA, otherwise fall back to
+	// Buildkite's "HEAD" sentinel, which resolves against Branch below.
+	commit := "HEAD"
+	if looksLikeSHA(webhook.Release.TargetCommitish) {
+		commit = webhook.Release.TargetCommitish
+	}
+
+	return &NormalizedEvent{
+		Kind:     eventRelease,
+		Repo:     webhook.Repository.FullName,
+		RepoName: webhook.Repository.Name,
+		Branch:   fmt.Sprintf("refs/tags/%s", webhook.Release.TagName),
+		Commit:   commit,
+		Message:  fmt.Sprintf("Release %s", webhook.Release.Name),
+		Pusher:   webhook.Sender.Login,
+		Tag:      webhook.Release.TagName,
+	}, nil
+}
+
+// looksLikeSHA reports whether s is plausibly a git commit hash rather than
+// a branch name (7-40 lowercase hex characters).
+func looksLikeSHA(s string) bool {
+	if len(s) < 7 || len(s) > 40 {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= '0' && r <= '9') && !(r >= 'a' && r <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// routingRule maps a repo+event pair to a pipeline slug (overriding the
+// URL-path slug) and optionally filters which branches/tags/PRs are built.
+type routingRule struct {
+	Repo         string   `json:"repo"`
+	Event        string   `json:"event"`
+	Pipeline     string   `json:"pipeline,omitempty"`
+	Branches     []string `json:"branches,omitempty"`
+	AllowForkPRs *bool    `json:"allow_fork_prs,omitempty"`
+}
+
+type routingConfigFile struct {
+	Rules []routingRule `json:"rules"`
+}
+
+// eventRoutes is loaded once at startup from ROUTING_CONFIG.
+var eventRoutes []routingRule
+
+func loadRoutingConfig(path string) ([]routingRule, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read routing config %s: %w", path, err)
+	}
+	var cfg routingConfigFile
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse routing config %s: %w", path, err)
+	}
+	return cfg.Rules, nil
+}
+
+func matchRoute(repo string, kind eventKind) *routingRule {
+	for i := range eventRoutes {
+		rule := &eventRoutes[i]
+		if rule.Repo == repo && rule.Event == string(kind) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// routedPipeline returns the rule's pipeline override, or the URL-path slug
+// if no rule matched or the rule didn't set one.
+func routedPipeline(urlSlug string, rule *routingRule) string {
+	if rule != nil && rule.Pipeline != "" {
+		return rule.Pipeline
+	}
+	return urlSlug
+}
+
+// eventAllowed applies a matched rule's branch/tag allowlist and fork-PR
+// filter. ref is the branch for push events, the base branch for PRs, or
+// the tag name for tag/release events.
+func eventAllowed(rule *routingRule, ref string, isForkPR bool) bool {
+	if rule == nil {
+		return true
+	}
+	if len(rule.Branches) > 0 {
+		allowed := false
+		for _, b := range rule.Branches {
+			if b == ref {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	if isForkPR && rule.AllowForkPRs != nil && !*rule.AllowForkPRs {
+		return false
+	}
+	return true
+}
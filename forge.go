@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// NormalizedEvent is what every Forge.Parse implementation produces: the
+// forge-specific payload reduced to the fields triggerBuild and the
+// routing/filtering rules actually need.
+type NormalizedEvent struct {
+	Kind          eventKind
+	Repo          string
+	RepoName      string
+	Branch        string // head branch (push/PR) or "refs/tags/<tag>" (tag event)
+	BaseBranch    string // PR target branch; empty otherwise
+	Commit        string
+	Message       string
+	AuthorName    string
+	AuthorEmail   string
+	Pusher        string
+	PullRequestID string
+	IsForkPR      bool
+	Tag           string // tag name, set for tag/release events
+}
+
+// FilterRef is the value routing rules match branch allowlists against:
+// the base branch for PRs, the tag for tag/release events, or the branch
+// for everything else.
+func (ne *NormalizedEvent) FilterRef() string {
+	switch ne.Kind {
+	case eventPullRequest:
+		return ne.BaseBranch
+	case eventTag, eventRelease:
+		return ne.Tag
+	default:
+		return ne.Branch
+	}
+}
+
+// toDelivery builds the queueable delivery for this event. ID and Pipeline
+// are filled in by the caller once routing has been resolved.
+func (ne *NormalizedEvent) toDelivery() *delivery {
+	d := &delivery{
+		Repo:                  ne.Repo,
+		Event:                 string(ne.Kind),
+		Branch:                ne.Branch,
+		Commit:                ne.Commit,
+		Message:               ne.Message,
+		PullRequestID:         ne.PullRequestID,
+		PullRequestBaseBranch: ne.BaseBranch,
+		Env: map[string]string{
+			"FORGEJO_PUSHER":    ne.Pusher,
+			"FORGEJO_REPO":      ne.Repo,
+			"FORGEJO_REPO_NAME": ne.RepoName,
+		},
+	}
+	if ne.AuthorName != "" || ne.AuthorEmail != "" {
+		d.Author = &BuildkiteAuthor{Name: ne.AuthorName, Email: ne.AuthorEmail}
+	}
+	if ne.Tag != "" {
+		d.Env["BUILDKITE_TAG"] = ne.Tag
+	}
+	return d
+}
+
+// Forge knows how to recognize, authenticate, and normalize webhook
+// deliveries from one code-hosting platform.
+type Forge interface {
+	Name() string
+	Detect(r *http.Request) bool
+	VerifySignature(body []byte, r *http.Request, secret string) error
+	Parse(r *http.Request, body []byte) (*NormalizedEvent, error)
+}
+
+// forges is tried in order; the first Detect match wins.
+var forges = []Forge{forgejoForge{}, githubForge{}, gitlabForge{}}
+
+// detectForge sniffs the request headers to pick a Forge, defaulting to
+// Forgejo/Gitea for backwards compatibility with older senders that may
+// not send an event header at all.
+func detectForge(r *http.Request) Forge {
+	for _, f := range forges {
+		if f.Detect(r) {
+			return f
+		}
+	}
+	return forgejoForge{}
+}
+
+// forgejoForge handles Forgejo and Gitea, which share a payload format.
+type forgejoForge struct{}
+
+func (forgejoForge) Name() string { return "forgejo" }
+
+func (forgejoForge) Detect(r *http.Request) bool {
+	return r.Header.Get("X-Gitea-Event") != "" || r.Header.Get("X-Forgejo-Event") != ""
+}
+
+func (forgejoForge) VerifySignature(body []byte, r *http.Request, secret string) error {
+	expected := hmacSHA256Hex(body, secret)
+	if sig := r.Header.Get("X-Gitea-Signature"); sig != "" {
+		return compareHexSignature(sig, expected)
+	}
+	if sig := r.Header.Get("X-Forgejo-Signature"); sig != "" {
+		return compareHexSignature(sig, expected)
+	}
+	if sig := r.Header.Get("X-Hub-Signature-256"); sig != "" {
+		return compareHexSignature(sig, expected)
+	}
+	return fmt.Errorf("no signature header present")
+}
+
+func (forgejoForge) Parse(r *http.Request, body []byte) (*NormalizedEvent, error) {
+	event := r.Header.Get("X-Gitea-Event")
+	if event == "" {
+		event = r.Header.Get("X-Forgejo-Event")
+	}
+	if event == "" {
+		event = string(eventPush)
+	}
+	return parseGiteaShapedEvent(eventKind(event), body)
+}
+
+// githubForge handles github.com and GitHub Enterprise. Gitea/Forgejo
+// modeled their webhook payloads on GitHub's, so the same per-event
+// parsers apply.
+type githubForge struct{}
+
+func (githubForge) Name() string { return "github" }
+
+func (githubForge) Detect(r *http.Request) bool {
+	return r.Header.Get("X-GitHub-Event") != ""
+}
+
+func (githubForge) VerifySignature(body []byte, r *http.Request, secret string) error {
+	sig := r.Header.Get("X-Hub-Signature-256")
+	if sig == "" {
+		return fmt.Errorf("no signature header present")
+	}
+	return compareHexSignature(sig, hmacSHA256Hex(body, secret))
+}
+
+func (githubForge) Parse(r *http.Request, body []byte) (*NormalizedEvent, error) {
+	return parseGiteaShapedEvent(eventKind(r.Header.Get("X-GitHub-Event")), body)
+}
+
+func parseGiteaShapedEvent(kind eventKind, body []byte) (*NormalizedEvent, error) {
+	switch kind {
+	case eventPush:
+		return parseGiteaPushEvent(body)
+	case eventPullRequest:
+		return parseGiteaPullRequestEvent(body)
+	case eventTag:
+		return parseGiteaTagEvent(body)
+	case eventRelease:
+		return parseGiteaReleaseEvent(body)
+	default:
+		return nil, fmt.Errorf("unsupported event type: %s", kind)
+	}
+}
+
+// gitlabForge handles GitLab, whose payload shapes and auth header differ
+// enough from the GitHub-style forges to need their own parsers.
+type gitlabForge struct{}
+
+func (gitlabForge) Name() string { return "gitlab" }
+
+func (gitlabForge) Detect(r *http.Request) bool {
+	return r.Header.Get("X-Gitlab-Event") != ""
+}
+
+// VerifySignature compares X-Gitlab-Token directly: GitLab sends the
+// configured secret verbatim rather than an HMAC of the body.
+func (gitlabForge) VerifySignature(body []byte, r *http.Request, secret string) error {
+	token := r.Header.Get("X-Gitlab-Token")
+	if token == "" {
+		return fmt.Errorf("no signature header present")
+	}
+	return compareToken(token, secret)
+}
+
+func (gitlabForge) Parse(r *http.Request, body []byte) (*NormalizedEvent, error) {
+	switch r.Header.Get("X-Gitlab-Event") {
+	case "Push Hook", "Tag Push Hook":
+		return parseGitLabPushEvent(body)
+	case "Merge Request Hook":
+		return parseGitLabMergeRequestEvent(body)
+	case "Release Hook":
+		return parseGitLabReleaseEvent(body)
+	default:
+		return nil, fmt.Errorf("unsupported event type: %s", r.Header.Get("X-Gitlab-Event"))
+	}
+}
+
+type gitlabProject struct {
+	PathWithNamespace string `json:"path_with_namespace"`
+	Name              string `json:"name"`
+}
+
+type gitlabPushWebhook struct {
+	ObjectKind   string        `json:"object_kind"`
+	Ref          string        `json:"ref"`
+	CheckoutSHA  string        `json:"checkout_sha"`
+	UserUsername string        `json:"user_username"`
+	Project      gitlabProject `json:"project"`
+	Commits      []struct {
+		Message string `json:"message"`
+		Author  struct {
+			Name  string `json:"name"`
+			Email string `json:"email"`
+		} `json:"author"`
+	} `json:"commits"`
+}
+
+func parseGitLabPushEvent(body []byte) (*NormalizedEvent, error) {
+	var webhook gitlabPushWebhook
+	if err := json.Unmarshal(body, &webhook); err != nil {
+		return nil, fmt.Errorf("invalid push payload: %w", err)
+	}
+
+	isTag := webhook.ObjectKind == "tag_push"
+	kind := eventPush
+	branch := strings.TrimPrefix(webhook.Ref, "refs/heads/")
+	tag := ""
+	if isTag {
+		kind = eventTag
+		branch = webhook.Ref
+		tag = strings.TrimPrefix(webhook.Ref, "refs/tags/")
+	}
+
+	var message, authorName, authorEmail string
+	if len(webhook.Commits) > 0 {
+		last := webhook.Commits[len(webhook.Commits)-1]
+		message = last.Message
+		authorName = last.Author.Name
+		authorEmail = last.Author.Email
+	}
+
+	return &NormalizedEvent{
+		Kind:        kind,
+		Repo:        webhook.Project.PathWithNamespace,
+		RepoName:    webhook.Project.Name,
+		Branch:      branch,
+		Commit:      webhook.CheckoutSHA,
+		Message:     message,
+		AuthorName:  authorName,
+		AuthorEmail: authorEmail,
+		Pusher:      webhook.UserUsername,
+		Tag:         tag,
+	}, nil
+}
+
+type gitlabMergeRequestWebhook struct {
+	User struct {
+		Username string `json:"username"`
+	} `json:"user"`
+	Project          gitlabProject `json:"project"`
+	ObjectAttributes struct {
+		IID          int    `json:"iid"`
+		Title        string `json:"title"`
+		SourceBranch string `json:"source_branch"`
+		TargetBranch string `json:"target_branch"`
+		LastCommit   struct {
+			ID string `json:"id"`
+		} `json:"last_commit"`
+		Source gitlabProject `json:"source"`
+		Target gitlabProject `json:"target"`
+	} `json:"object_attributes"`
+}
+
+func parseGitLabMergeRequestEvent(body []byte) (*NormalizedEvent, error) {
+	var webhook gitlabMergeRequestWebhook
+	if err := json.Unmarshal(body, &webhook); err != nil {
+		return nil, fmt.Errorf("invalid merge_request payload: %w", err)
+	}
+
+	attrs := webhook.ObjectAttributes
+	return &NormalizedEvent{
+		Kind:          eventPullRequest,
+		Repo:          webhook.Project.PathWithNamespace,
+		RepoName:      webhook.Project.Name,
+		Branch:        attrs.SourceBranch,
+		BaseBranch:    attrs.TargetBranch,
+		Commit:        attrs.LastCommit.ID,
+		Message:       fmt.Sprintf("MR !%d: %s", attrs.IID, attrs.Title),
+		Pusher:        webhook.User.Username,
+		PullRequestID: fmt.Sprintf("%d", attrs.IID),
+		IsForkPR:      attrs.Source.PathWithNamespace != attrs.Target.PathWithNamespace,
+	}, nil
+}
+
+type gitlabReleaseWebhook struct {
+	Tag     string        `json:"tag"`
+	Name    string        `json:"name"`
+	Project gitlabProject `json:"project"`
+	Commit  struct {
+		ID string `json:"id"`
+	} `json:"commit"`
+}
+
+func parseGitLabReleaseEvent(body []byte) (*NormalizedEvent, error) {
+	var webhook gitlabReleaseWebhook
+	if err := json.Unmarshal(body, &webhook); err != nil {
+		return nil, fmt.Errorf("invalid release payload: %w", err)
+	}
+
+	return &NormalizedEvent{
+		Kind:     eventRelease,
+		Repo:     webhook.Project.PathWithNamespace,
+		RepoName: webhook.Project.Name,
+		Branch:   fmt.Sprintf("refs/tags/%s", webhook.Tag),
+		Commit:   webhook.Commit.ID,
+		Message:  fmt.Sprintf("Release %s", webhook.Name),
+		Tag:      webhook.Tag,
+	}, nil
+}
@@ -8,6 +8,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/joho/godotenv"
@@ -32,17 +33,20 @@ type ForgejoWebhook struct {
 		} `json:"author"`
 	} `json:"head_commit"`
 	Pusher struct {
-		Username string `json:"username"`
+		Username string `json:"username"` // Forgejo/Gitea
+		Name     string `json:"name"`     // GitHub
 	} `json:"pusher"`
 }
 
 // BuildkitePayload represents the payload to send to Buildkite
 type BuildkitePayload struct {
-	Commit  string            `json:"commit"`
-	Branch  string            `json:"branch"`
-	Message string            `json:"message"`
-	Author  *BuildkiteAuthor  `json:"author,omitempty"`
-	Env     map[string]string `json:"env,omitempty"`
+	Commit                string            `json:"commit"`
+	Branch                string            `json:"branch"`
+	Message               string            `json:"message"`
+	Author                *BuildkiteAuthor  `json:"author,omitempty"`
+	Env                   map[string]string `json:"env,omitempty"`
+	PullRequestID         string            `json:"pull_request_id,omitempty"`
+	PullRequestBaseBranch string            `json:"pull_request_base_branch,omitempty"`
 }
 
 // BuildkiteAuthor represents the commit author
@@ -56,6 +60,7 @@ var (
 	buildkiteToken string
 	port           string
 	logVerbose     bool
+	queue          *deliveryQueue
 )
 
 func getEnv(key, fallback string) string {
@@ -65,6 +70,19 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
+func getEnvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("⚠️  Invalid %s=%q, using default %d", key, value, fallback)
+		return fallback
+	}
+	return n
+}
+
 func main() {
 	// Load .env file if it exists (ignore errors if file doesn't exist)
 	_ = godotenv.Load()
@@ -74,14 +92,42 @@ func main() {
 	buildkiteToken = os.Getenv("BUILDKITE_TOKEN")
 	port = getEnv("WEBHOOK_PORT", "8080")
 	logVerbose = getEnv("LOG_VERBOSE", "false") == "true"
+	allowUnsigned = getEnv("WEBHOOK_ALLOW_UNSIGNED", "false") == "true"
 
 	if buildkiteOrg == "" || buildkiteToken == "" {
 		log.Fatal("Error: BUILDKITE_ORG and BUILDKITE_TOKEN environment variables must be set\n" +
 			"Get token from: https://buildkite.com/user/api-access-tokens (requires write_builds scope)")
 	}
 
+	cfg, err := loadSecretConfig(os.Getenv("WEBHOOK_SECRET_CONFIG"))
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	secretConfig = cfg
+
+	routes, err := loadRoutingConfig(os.Getenv("ROUTING_CONFIG"))
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	eventRoutes = routes
+
+	stateDir := getEnv("STATE_DIR", "./state")
+	maxAttempts := getEnvInt("WEBHOOK_MAX_ATTEMPTS", 10)
+	workerCount := getEnvInt("WORKER_COUNT", 4)
+
+	q, err := newDeliveryQueue(stateDir, maxAttempts)
+	if err != nil {
+		log.Fatalf("Error: failed to initialize delivery queue: %v", err)
+	}
+	queue = q
+	queue.run(workerCount)
+	initScripts()
+
 	http.HandleFunc("/webhook/", webhookHandler)
 	http.HandleFunc("/health", healthHandler)
+	http.HandleFunc("/api/deliveries", deliveriesHandler)
+	http.HandleFunc("/jobs", jobsHandler)
+	http.HandleFunc("/jobs/", jobsHandler)
 	http.HandleFunc("/", rootHandler)
 
 	log.Printf("🚀 Buildkite-Forgejo Webhook Bridge v%s", version)
@@ -143,12 +189,29 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func healthHandler(w http.ResponseWriter, r *http.Request) {
+	pending, inFlight, failed := queue.stats()
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"status":  "healthy",
 		"version": version,
 		"org":     buildkiteOrg,
+		"queue": map[string]int{
+			"pending":   pending,
+			"in_flight": inFlight,
+			"failed":    failed,
+		},
+	})
+}
+
+// deliveriesHandler lists queued deliveries so operators can see stuck or
+// failed builds without digging through the log file.
+func deliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"deliveries": queue.list(),
 	})
 }
 
@@ -177,67 +240,100 @@ func webhookHandler(w http.ResponseWriter, r *http.Request) {
 		log.Printf("📦 Received payload: %s", string(body))
 	}
 
-	var webhook ForgejoWebhook
-	if err := json.Unmarshal(body, &webhook); err != nil {
-		log.Printf("❌ Error parsing webhook: %v", err)
+	forge := detectForge(r)
+
+	secret, haveSecret := resolveSecret(path)
+	if haveSecret {
+		if err := forge.VerifySignature(body, r, secret); err != nil {
+			log.Printf("🔒 Rejected webhook for pipeline=%s from %s: %v", path, r.RemoteAddr, err)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	} else if !allowUnsigned {
+		log.Printf("🔒 Rejected webhook for pipeline=%s from %s: no secret configured", path, r.RemoteAddr)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ne, err := forge.Parse(r, body)
+	if err != nil {
+		log.Printf("❌ Error parsing %s webhook: %v", forge.Name(), err)
 		http.Error(w, "Bad request: invalid JSON", http.StatusBadRequest)
 		return
 	}
+	if ne == nil {
+		// e.g. a "create" event for a branch rather than a tag
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"status": "ignored"})
+		return
+	}
 
-	// Extract branch from ref (refs/heads/main -> main)
-	branch := strings.TrimPrefix(webhook.Ref, "refs/heads/")
-	commitShort := webhook.HeadCommit.ID
+	rule := matchRoute(ne.Repo, ne.Kind)
+	pipeline := routedPipeline(path, rule)
+	if !eventAllowed(rule, ne.FilterRef(), ne.IsForkPR) {
+		log.Printf("⏭️  Skipping %s event for repo=%s (filtered by routing rule)", ne.Kind, ne.Repo)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"status": "skipped", "event": string(ne.Kind)})
+		return
+	}
+
+	commitShort := ne.Commit
 	if len(commitShort) > 7 {
 		commitShort = commitShort[:7]
 	}
 
-	log.Printf("📨 Webhook: repo=%s, branch=%s, commit=%s, author=%s",
-		webhook.Repository.FullName, branch, commitShort, webhook.Pusher.Username)
+	log.Printf("📨 Webhook: forge=%s, event=%s, repo=%s, pipeline=%s, branch=%s, commit=%s",
+		forge.Name(), ne.Kind, ne.Repo, pipeline, ne.Branch, commitShort)
 
-	// Trigger Buildkite build
-	if err := triggerBuild(path, branch, webhook.HeadCommit.ID, webhook.HeadCommit.Message, &webhook); err != nil {
-		log.Printf("❌ Failed to trigger build: %v", err)
-		http.Error(w, fmt.Sprintf("Failed to trigger build: %v", err), http.StatusInternalServerError)
-		return
-	}
+	// Queue the delivery and return immediately; a worker will trigger the
+	// Buildkite build, retrying with backoff if it fails.
+	d := ne.toDelivery()
+	d.ID = generateDeliveryID()
+	d.Pipeline = pipeline
+	d.RawPayload = json.RawMessage(body)
+	queue.enqueue(d)
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(http.StatusAccepted)
 	json.NewEncoder(w).Encode(map[string]string{
-		"status":   "success",
-		"message":  "Build triggered successfully",
-		"pipeline": path,
-		"branch":   branch,
-		"commit":   commitShort,
+		"status":      "accepted",
+		"message":     "Delivery queued for build",
+		"delivery_id": d.ID,
+		"pipeline":    pipeline,
+		"branch":      d.Branch,
+		"commit":      commitShort,
 	})
 }
 
-func triggerBuild(pipeline, branch, commit, message string, webhook *ForgejoWebhook) error {
-	url := fmt.Sprintf("https://api.buildkite.com/v2/organizations/%s/pipelines/%s/builds", buildkiteOrg, pipeline)
-	
+// buildkiteBuildResponse is the subset of Buildkite's build-creation
+// response we care about.
+type buildkiteBuildResponse struct {
+	WebURL string `json:"web_url"`
+}
+
+func triggerBuild(d *delivery) (string, error) {
+	url := fmt.Sprintf("https://api.buildkite.com/v2/organizations/%s/pipelines/%s/builds", buildkiteOrg, d.Pipeline)
+
 	if logVerbose {
-		log.Printf("🔍 Debug: buildkiteOrg='%s', pipeline='%s'", buildkiteOrg, pipeline)
+		log.Printf("🔍 Debug: buildkiteOrg='%s', pipeline='%s'", buildkiteOrg, d.Pipeline)
 		log.Printf("🔍 Debug: URL='%s'", url)
 	}
 
 	payload := BuildkitePayload{
-		Commit:  commit,
-		Branch:  branch,
-		Message: message,
-		Author: &BuildkiteAuthor{
-			Name:  webhook.HeadCommit.Author.Name,
-			Email: webhook.HeadCommit.Author.Email,
-		},
-		Env: map[string]string{
-			"FORGEJO_PUSHER":   webhook.Pusher.Username,
-			"FORGEJO_REPO":     webhook.Repository.FullName,
-			"FORGEJO_REPO_NAME": webhook.Repository.Name,
-		},
+		Commit:                d.Commit,
+		Branch:                d.Branch,
+		Message:               d.Message,
+		Author:                d.Author,
+		Env:                   d.Env,
+		PullRequestID:         d.PullRequestID,
+		PullRequestBaseBranch: d.PullRequestBaseBranch,
 	}
 
 	jsonData, err := json.Marshal(payload)
 	if err != nil {
-		return fmt.Errorf("failed to marshal payload: %w", err)
+		return "", fmt.Errorf("failed to marshal payload: %w", err)
 	}
 
 	if logVerbose {
@@ -246,7 +342,7 @@ func triggerBuild(pipeline, branch, commit, message string, webhook *ForgejoWebh
 
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return "", fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Authorization", "Bearer "+buildkiteToken)
@@ -255,20 +351,27 @@ func triggerBuild(pipeline, branch, commit, message string, webhook *ForgejoWebh
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("request failed: %w", err)
+		return "", fmt.Errorf("request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	respBody, _ := io.ReadAll(resp.Body)
 
 	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("buildkite API returned %d: %s", resp.StatusCode, string(respBody))
+		return "", fmt.Errorf("buildkite API returned %d: %s", resp.StatusCode, string(respBody))
 	}
 
 	if logVerbose {
 		log.Printf("📥 Buildkite response: %s", string(respBody))
 	}
 
-	log.Printf("✅ Build triggered: %s/%s (branch: %s, commit: %s)", buildkiteOrg, pipeline, branch, commit[:7])
-	return nil
+	var build buildkiteBuildResponse
+	_ = json.Unmarshal(respBody, &build)
+
+	commitShort := d.Commit
+	if len(commitShort) > 7 {
+		commitShort = commitShort[:7]
+	}
+	log.Printf("✅ Build triggered: %s/%s (branch: %s, commit: %s)", buildkiteOrg, d.Pipeline, d.Branch, commitShort)
+	return build.WebURL, nil
 }
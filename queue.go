@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// generateDeliveryID returns a short random hex ID for a queued delivery.
+func generateDeliveryID() string {
+	buf := make([]byte, 8)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// deliveryStatus is the lifecycle state of a queued delivery.
+type deliveryStatus string
+
+const (
+	statusPending  deliveryStatus = "pending"
+	statusInFlight deliveryStatus = "in_flight"
+	statusFailed   deliveryStatus = "failed"
+	statusDone     deliveryStatus = "done"
+)
+
+// delivery is a single accepted webhook delivery waiting to be (re)sent to
+// Buildkite. Each state change is appended as a full snapshot to the
+// durable log so a restart can replay unfinished work.
+type delivery struct {
+	ID                    string            `json:"id"`
+	Pipeline              string            `json:"pipeline"`
+	Repo                  string            `json:"repo,omitempty"`
+	Event                 string            `json:"event,omitempty"`
+	Branch                string            `json:"branch"`
+	Commit                string            `json:"commit"`
+	Message               string            `json:"message"`
+	Author                *BuildkiteAuthor  `json:"author,omitempty"`
+	Env                   map[string]string `json:"env,omitempty"`
+	PullRequestID         string            `json:"pull_request_id,omitempty"`
+	PullRequestBaseBranch string            `json:"pull_request_base_branch,omitempty"`
+	RawPayload            json.RawMessage   `json:"raw_payload,omitempty"`
+	Status                deliveryStatus    `json:"status"`
+	Attempts              int               `json:"attempts"`
+	LastError             string            `json:"last_error,omitempty"`
+	NextAttemptAt         time.Time         `json:"next_attempt_at,omitempty"`
+	CreatedAt             time.Time         `json:"created_at"`
+	UpdatedAt             time.Time         `json:"updated_at"`
+}
+
+// deliveryQueue is a durable backlog of deliveries backed by an append-only
+// JSON-lines file under STATE_DIR, drained by a pool of worker goroutines
+// that retry failed Buildkite API calls with exponential backoff.
+type deliveryQueue struct {
+	mu      sync.Mutex
+	items   map[string]*delivery
+	logFile *os.File
+	logPath string
+	ch      chan string
+
+	// pendingReplay holds IDs recovered from the log on startup; run()
+	// feeds them onto ch once workers are draining it, so a backlog
+	// larger than ch's buffer can't deadlock construction.
+	pendingReplay []string
+
+	// appendsSinceCompact counts log writes since the log was last
+	// rewritten down to current state; compactLocked resets it.
+	appendsSinceCompact int
+
+	maxAttempts int
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+}
+
+// compactEvery is how many log appends accumulate before the durable log is
+// rewritten to just the current snapshot of items, so a long-lived process
+// doesn't grow deliveries.jsonl (and the replay-on-restart memory it takes
+// to read it back) without bound.
+const compactEvery = 500
+
+func newDeliveryQueue(stateDir string, maxAttempts int) (*deliveryQueue, error) {
+	if err := os.MkdirAll(stateDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create state dir %s: %w", stateDir, err)
+	}
+
+	logPath := filepath.Join(stateDir, "deliveries.jsonl")
+	q := &deliveryQueue{
+		items:       make(map[string]*delivery),
+		logPath:     logPath,
+		ch:          make(chan string, 1024),
+		maxAttempts: maxAttempts,
+		baseBackoff: time.Second,
+		maxBackoff:  5 * time.Minute,
+	}
+
+	if err := q.replay(logPath); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open delivery log %s: %w", logPath, err)
+	}
+	q.logFile = f
+
+	return q, nil
+}
+
+// replay reconstructs queue state from the log (each line is the latest
+// snapshot of a delivery at the time it was written) and re-enqueues
+// anything that wasn't finished before the process last exited.
+func (q *deliveryQueue) replay(logPath string) error {
+	f, err := os.Open(logPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read delivery log %s: %w", logPath, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var d delivery
+		if err := json.Unmarshal(scanner.Bytes(), &d); err != nil {
+			log.Printf("⚠️  Skipping malformed delivery log entry: %v", err)
+			continue
+		}
+		q.items[d.ID] = &d
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to scan delivery log %s: %w", logPath, err)
+	}
+
+	for id, d := range q.items {
+		switch d.Status {
+		case statusPending, statusInFlight:
+			d.Status = statusPending
+			q.pendingReplay = append(q.pendingReplay, id)
+		case statusDone:
+			// Terminal and already built; don't carry it across a restart.
+			delete(q.items, id)
+		}
+	}
+	if len(q.pendingReplay) > 0 {
+		log.Printf("🔁 Replaying %d unfinished delivery(s) from %s", len(q.pendingReplay), logPath)
+	}
+	return nil
+}
+
+// append writes the current snapshot of d to the durable log, then
+// compacts the log down to the live item set once enough snapshots have
+// accumulated. Callers must hold q.mu.
+func (q *deliveryQueue) append(d *delivery) {
+	data, err := json.Marshal(d)
+	if err != nil {
+		log.Printf("⚠️  Failed to marshal delivery %s for log: %v", d.ID, err)
+		return
+	}
+	data = append(data, '\n')
+	if _, err := q.logFile.Write(data); err != nil {
+		log.Printf("⚠️  Failed to append delivery %s to log: %v", d.ID, err)
+		return
+	}
+
+	q.appendsSinceCompact++
+	if q.appendsSinceCompact >= compactEvery {
+		q.compactLocked()
+		q.appendsSinceCompact = 0
+	}
+}
+
+// compactLocked rewrites the durable log to hold only the current snapshot
+// of q.items, dropping the history of intermediate state transitions for
+// long-finished deliveries. Callers must hold q.mu.
+func (q *deliveryQueue) compactLocked() {
+	tmpPath := q.logPath + ".compact"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		log.Printf("⚠️  Failed to compact delivery log: %v", err)
+		return
+	}
+
+	for _, d := range q.items {
+		data, err := json.Marshal(d)
+		if err != nil {
+			continue
+		}
+		if _, err := f.Write(append(data, '\n')); err != nil {
+			log.Printf("⚠️  Failed to compact delivery log: %v", err)
+			f.Close()
+			os.Remove(tmpPath)
+			return
+		}
+	}
+	f.Close()
+
+	if err := os.Rename(tmpPath, q.logPath); err != nil {
+		log.Printf("⚠️  Failed to swap compacted delivery log: %v", err)
+		return
+	}
+
+	q.logFile.Close()
+	newFile, err := os.OpenFile(q.logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		log.Printf("⚠️  Failed to reopen delivery log after compaction: %v", err)
+		return
+	}
+	q.logFile = newFile
+}
+
+func (q *deliveryQueue) enqueue(d *delivery) {
+	d.Status = statusPending
+	d.CreatedAt = time.Now()
+	d.UpdatedAt = time.Now()
+
+	q.mu.Lock()
+	q.items[d.ID] = d
+	q.append(d)
+	q.mu.Unlock()
+
+	q.ch <- d.ID
+}
+
+func (q *deliveryQueue) update(id string, fn func(d *delivery)) {
+	q.mu.Lock()
+	d, ok := q.items[id]
+	if !ok {
+		q.mu.Unlock()
+		return
+	}
+	fn(d)
+	d.UpdatedAt = time.Now()
+	q.append(d)
+	if d.Status == statusDone {
+		// Terminal and already built; don't keep it in memory or return it
+		// from list() indefinitely.
+		delete(q.items, id)
+	}
+	q.mu.Unlock()
+}
+
+// stats returns the pending, in-flight, and failed counts for /health.
+func (q *deliveryQueue) stats() (pending, inFlight, failed int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, d := range q.items {
+		switch d.Status {
+		case statusPending:
+			pending++
+		case statusInFlight:
+			inFlight++
+		case statusFailed:
+			failed++
+		}
+	}
+	return
+}
+
+// list returns a snapshot of every delivery that hasn't finished
+// successfully yet (pending, in-flight, or failed) for the /api/deliveries
+// endpoint. done deliveries are dropped from items as soon as they finish,
+// so operators see the deliveries that still need attention, not a
+// forever-growing history.
+func (q *deliveryQueue) list() []*delivery {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out := make([]*delivery, 0, len(q.items))
+	for _, d := range q.items {
+		copy := *d
+		out = append(out, &copy)
+	}
+	return out
+}
+
+// run starts n worker goroutines draining the queue, then hands off any
+// deliveries recovered from the log on startup.
+func (q *deliveryQueue) run(n int) {
+	for i := 0; i < n; i++ {
+		go q.worker()
+	}
+
+	pending := q.pendingReplay
+	q.pendingReplay = nil
+	go func() {
+		for _, id := range pending {
+			q.ch <- id
+		}
+	}()
+}
+
+func (q *deliveryQueue) worker() {
+	for id := range q.ch {
+		q.process(id)
+	}
+}
+
+// process makes a single delivery attempt to Buildkite. On failure it
+// schedules a retry via time.AfterFunc and returns immediately rather than
+// blocking the worker goroutine for the backoff duration — a worker must be
+// free to pick up other deliveries while this one is waiting to retry.
+func (q *deliveryQueue) process(id string) {
+	q.mu.Lock()
+	d, ok := q.items[id]
+	q.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	var attempts int
+	q.update(id, func(d *delivery) {
+		d.Status = statusInFlight
+		d.Attempts++
+		attempts = d.Attempts
+	})
+
+	buildURL, err := triggerBuild(d)
+	if err == nil {
+		q.update(id, func(d *delivery) {
+			d.Status = statusDone
+			d.LastError = ""
+		})
+		runPostTriggerScript(d, buildURL, nil)
+		return
+	}
+
+	log.Printf("❌ Delivery %s failed (attempt %d/%d): %v", id, attempts, q.maxAttempts, err)
+
+	if attempts >= q.maxAttempts {
+		q.update(id, func(d *delivery) {
+			d.Status = statusFailed
+			d.LastError = err.Error()
+		})
+		runPostTriggerScript(d, "", err)
+		return
+	}
+
+	backoff := q.backoffFor(attempts)
+	nextAttempt := time.Now().Add(backoff)
+	q.update(id, func(d *delivery) {
+		d.LastError = err.Error()
+		d.NextAttemptAt = nextAttempt
+	})
+	time.AfterFunc(backoff, func() { q.ch <- id })
+}
+
+// backoffFor returns the delay before the (attempts+1)th try: baseBackoff
+// doubled once per prior attempt, capped at maxBackoff.
+func (q *deliveryQueue) backoffFor(attempts int) time.Duration {
+	backoff := q.baseBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= q.maxBackoff {
+			return q.maxBackoff
+		}
+	}
+	return backoff
+}
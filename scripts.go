@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scriptsDir returns SCRIPTS_DIR, or "" if the post-trigger script feature
+// is disabled.
+func scriptsDir() string {
+	return os.Getenv("SCRIPTS_DIR")
+}
+
+// scriptsSem caps how many post-trigger scripts run concurrently.
+var scriptsSem chan struct{}
+
+func initScripts() {
+	scriptsSem = make(chan struct{}, getEnvInt("SCRIPTS_CONCURRENCY", 4))
+}
+
+// job tracks one post-trigger script execution so its output can be tailed
+// live over SSE and inspected afterwards.
+type job struct {
+	ID         string    `json:"id"`
+	Pipeline   string    `json:"pipeline"`
+	Repo       string    `json:"repo"`
+	Event      string    `json:"event"`
+	Command    string    `json:"command"`
+	Status     string    `json:"status"` // running, done, failed, timeout
+	ExitCode   int       `json:"exit_code"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+
+	mu          sync.Mutex
+	lines       []string
+	subscribers map[chan string]struct{}
+}
+
+const maxJobOutputLines = 2000
+
+func (j *job) appendLine(line string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.lines = append(j.lines, line)
+	if len(j.lines) > maxJobOutputLines {
+		j.lines = j.lines[len(j.lines)-maxJobOutputLines:]
+	}
+	for ch := range j.subscribers {
+		select {
+		case ch <- line:
+		default:
+			// slow subscriber; drop the line rather than block the job
+		}
+	}
+}
+
+func (j *job) subscribe() (chan string, []string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	backlog := append([]string(nil), j.lines...)
+
+	if !j.FinishedAt.IsZero() {
+		// Job already finished; hand back a closed channel so the stream
+		// handler flushes the backlog and immediately emits the terminal
+		// event instead of blocking on a channel nothing will ever close.
+		ch := make(chan string)
+		close(ch)
+		return ch, backlog
+	}
+
+	ch := make(chan string, 64)
+	if j.subscribers == nil {
+		j.subscribers = make(map[chan string]struct{})
+	}
+	j.subscribers[ch] = struct{}{}
+	return ch, backlog
+}
+
+func (j *job) unsubscribe(ch chan string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	delete(j.subscribers, ch)
+}
+
+func (j *job) finish(status string, exitCode int) {
+	j.mu.Lock()
+	j.Status = status
+	j.ExitCode = exitCode
+	j.FinishedAt = time.Now()
+	for ch := range j.subscribers {
+		close(ch)
+	}
+	j.subscribers = nil
+	j.mu.Unlock()
+}
+
+var (
+	jobsMu sync.Mutex
+	jobs   = map[string]*job{}
+)
+
+func getJob(id string) (*job, bool) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	j, ok := jobs[id]
+	return j, ok
+}
+
+func listJobs() []*job {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	out := make([]*job, 0, len(jobs))
+	for _, j := range jobs {
+		out = append(out, j)
+	}
+	return out
+}
+
+// resolveScriptPath looks for SCRIPTS_DIR/<pipeline-slug>, falling back to
+// SCRIPTS_DIR/<repo>/<event>, and refuses anything that resolves (after
+// symlinks) outside SCRIPTS_DIR.
+func resolveScriptPath(d *delivery) (string, bool) {
+	dir := scriptsDir()
+	if dir == "" {
+		return "", false
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", false
+	}
+
+	candidates := []string{
+		filepath.Join(absDir, d.Pipeline),
+		filepath.Join(absDir, d.Repo, d.Event),
+	}
+
+	for _, candidate := range candidates {
+		resolved, err := filepath.EvalSymlinks(candidate)
+		if err != nil {
+			continue
+		}
+		if resolved != absDir && !strings.HasPrefix(resolved, absDir+string(os.PathSeparator)) {
+			continue
+		}
+		info, err := os.Stat(resolved)
+		if err != nil || info.IsDir() || info.Mode()&0o111 == 0 {
+			continue
+		}
+		return resolved, true
+	}
+	return "", false
+}
+
+// runPostTriggerScript spawns the script matching d (if any) with the
+// webhook fields exported as env vars and the raw payload on stdin,
+// streaming its output into a job that can be tailed via SSE. It fires
+// whether Buildkite accepted the build, rejected it, or exhausted its
+// retries (buildURL is "" and buildErr is set in the failure case) — it's
+// the local-hook escape hatch operators fall back to when Buildkite itself
+// is the thing that's down, so it can't be gated on Buildkite succeeding.
+func runPostTriggerScript(d *delivery, buildURL string, buildErr error) {
+	path, ok := resolveScriptPath(d)
+	if !ok {
+		return
+	}
+
+	j := &job{
+		ID:        generateDeliveryID(),
+		Pipeline:  d.Pipeline,
+		Repo:      d.Repo,
+		Event:     d.Event,
+		Command:   path,
+		Status:    "running",
+		StartedAt: time.Now(),
+	}
+	jobsMu.Lock()
+	jobs[j.ID] = j
+	jobsMu.Unlock()
+
+	go func() {
+		scriptsSem <- struct{}{}
+		defer func() { <-scriptsSem }()
+
+		timeout := time.Duration(getEnvInt("SCRIPTS_TIMEOUT_SECONDS", 300)) * time.Second
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		buildStatus := "success"
+		buildError := ""
+		if buildErr != nil {
+			buildStatus = "failed"
+			buildError = buildErr.Error()
+		}
+
+		cmd := exec.CommandContext(ctx, path)
+		cmd.Env = append(os.Environ(),
+			"FORGEJO_REPO="+d.Repo,
+			"FORGEJO_BRANCH="+d.Branch,
+			"FORGEJO_COMMIT="+d.Commit,
+			"FORGEJO_PUSHER="+d.Env["FORGEJO_PUSHER"],
+			"BUILDKITE_BUILD_URL="+buildURL,
+			"BUILDKITE_BUILD_STATUS="+buildStatus,
+			"BUILDKITE_BUILD_ERROR="+buildError,
+		)
+		cmd.Stdin = bytes.NewReader(d.RawPayload)
+
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			log.Printf("❌ Job %s: failed to open stdout: %v", j.ID, err)
+			j.finish("failed", -1)
+			return
+		}
+		stderr, err := cmd.StderrPipe()
+		if err != nil {
+			log.Printf("❌ Job %s: failed to open stderr: %v", j.ID, err)
+			j.finish("failed", -1)
+			return
+		}
+
+		if err := cmd.Start(); err != nil {
+			log.Printf("❌ Job %s: failed to start %s: %v", j.ID, path, err)
+			j.finish("failed", -1)
+			return
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() { defer wg.Done(); streamLines(stdout, j) }()
+		go func() { defer wg.Done(); streamLines(stderr, j) }()
+		wg.Wait()
+
+		err = cmd.Wait()
+		switch {
+		case ctx.Err() == context.DeadlineExceeded:
+			j.finish("timeout", -1)
+		case err != nil:
+			exitCode := -1
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				exitCode = exitErr.ExitCode()
+			}
+			j.finish("failed", exitCode)
+		default:
+			j.finish("done", 0)
+		}
+	}()
+}
+
+func streamLines(r io.Reader, j *job) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		j.appendLine(scanner.Text())
+	}
+}
+
+// jobsHandler serves GET /jobs, GET /jobs/<id>, and GET /jobs/<id>/stream.
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	trimmed := strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs"), "/")
+	if trimmed == "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"jobs": listJobs()})
+		return
+	}
+
+	parts := strings.Split(trimmed, "/")
+	id := parts[0]
+	j, ok := getJob(id)
+	if !ok {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "stream" {
+		jobStreamHandler(w, r, j)
+		return
+	}
+	if len(parts) == 1 {
+		w.Header().Set("Content-Type", "application/json")
+		j.mu.Lock()
+		output := strings.Join(j.lines, "\n")
+		j.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":          j.ID,
+			"pipeline":    j.Pipeline,
+			"repo":        j.Repo,
+			"event":       j.Event,
+			"command":     j.Command,
+			"status":      j.Status,
+			"exit_code":   j.ExitCode,
+			"started_at":  j.StartedAt,
+			"finished_at": j.FinishedAt,
+			"output":      output,
+		})
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func jobStreamHandler(w http.ResponseWriter, r *http.Request, j *job) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	ch, backlog := j.subscribe()
+	defer j.unsubscribe(ch)
+
+	for _, line := range backlog {
+		fmt.Fprintf(w, "data: %s\n\n", line)
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case line, open := <-ch:
+			if !open {
+				fmt.Fprintf(w, "event: end\ndata: %s\n\n", j.Status)
+				flusher.Flush()
+				return
+			}
+			fmt.Fprintf(w, "data: %s\n\n", line)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
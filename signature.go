@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// secretConfig holds the per-pipeline secrets loaded from WEBHOOK_SECRET_CONFIG,
+// a flat JSON object mapping pipeline slug -> shared secret, e.g.
+//
+//	{"my-app": "s3cr3t", "other-app": "s3cr3t2"}
+var secretConfig map[string]string
+
+// allowUnsigned lets operators run without signature verification (e.g. local
+// testing); it is false unless WEBHOOK_ALLOW_UNSIGNED=true is set explicitly.
+var allowUnsigned bool
+
+func loadSecretConfig(path string) (map[string]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secret config %s: %w", path, err)
+	}
+	var cfg map[string]string
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse secret config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// secretEnvKey turns a pipeline slug into the env var name we look it up
+// under, e.g. "my-app" -> "WEBHOOK_SECRET_MY_APP".
+func secretEnvKey(pipeline string) string {
+	normalized := strings.NewReplacer("-", "_", ".", "_", "/", "_").Replace(pipeline)
+	return "WEBHOOK_SECRET_" + strings.ToUpper(normalized)
+}
+
+// resolveSecret returns the shared secret to use for a pipeline slug, trying
+// (in order) the per-pipeline env var, the config file, and finally the
+// global WEBHOOK_SECRET fallback. The bool result reports whether any secret
+// was found at all.
+func resolveSecret(pipeline string) (string, bool) {
+	if secret := os.Getenv(secretEnvKey(pipeline)); secret != "" {
+		return secret, true
+	}
+	if secret, ok := secretConfig[pipeline]; ok && secret != "" {
+		return secret, true
+	}
+	if secret := os.Getenv("WEBHOOK_SECRET"); secret != "" {
+		return secret, true
+	}
+	return "", false
+}
+
+// hmacSHA256Hex computes the hex-encoded HMAC-SHA256 of body under secret.
+func hmacSHA256Hex(body []byte, secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// compareHexSignature checks a hex-encoded signature (optionally prefixed,
+// e.g. "sha256=...") against the expected HMAC.
+func compareHexSignature(got string, expected []byte) error {
+	got = strings.TrimPrefix(got, "sha256=")
+	decoded, err := hex.DecodeString(got)
+	if err != nil {
+		return fmt.Errorf("malformed signature: %w", err)
+	}
+	if !hmac.Equal(decoded, expected) {
+		return fmt.Errorf("signature mismatch")
+	}
+	return nil
+}
+
+// compareToken does a constant-time comparison of a plain shared-secret
+// token (e.g. GitLab's X-Gitlab-Token), which isn't HMAC-signed.
+func compareToken(got, secret string) error {
+	if subtle.ConstantTimeCompare([]byte(got), []byte(secret)) != 1 {
+		return fmt.Errorf("token mismatch")
+	}
+	return nil
+}